@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditConfig controls what auditTransport redacts before handing a
+// request off to its sink. It is set from the main configuration file.
+var auditConfig = struct {
+	// RedactHeaders lists header names (case-insensitive) whose values are
+	// replaced with "REDACTED" in audit records.
+	RedactHeaders []string
+	// RedactQueryParams lists patterns matched against query parameter
+	// names; matching values are replaced with "REDACTED".
+	RedactQueryParams []*regexp.Regexp
+}{
+	RedactHeaders: []string{"Authorization", "Cookie", "Proxy-Authorization"},
+}
+
+// An auditRecord is the structured log entry captured for one upstream
+// request by auditTransport.
+type auditRecord struct {
+	Time           time.Time         `json:"time"`
+	Method         string            `json:"method"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Proxy          string            `json:"proxy,omitempty"`
+	TLSVersion     string            `json:"tlsVersion,omitempty"`
+	TLSCipher      string            `json:"tlsCipher,omitempty"`
+	PeerCertSPKI   string            `json:"peerCertSpki,omitempty"`
+	HTTPVersion    string            `json:"httpVersion,omitempty"`
+	StatusCode     int               `json:"statusCode,omitempty"`
+	BytesSent      int64             `json:"bytesSent"`
+	BytesReceived  int64             `json:"bytesReceived"`
+	TTFBMillis     int64             `json:"ttfbMs"`
+	Classification string            `json:"classification,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// An auditSink is a destination for audit records: a JSON lines file,
+// syslog, an HTTP webhook, or any other pluggable implementation.
+type auditSink interface {
+	Write(rec *auditRecord) error
+}
+
+// An auditTransport wraps another RoundTripper (typically
+// hardValidationTransport wrapping httpTransport/http2Transport) and
+// records a structured auditRecord for every request it handles: method,
+// URL, proxy (the first upstream of the matching proxy rule, which is not
+// necessarily the one the connection went through after a failover), TLS
+// parameters, HTTP version, byte counts, TTFB, and
+// (once available) the classification result. This replaces the ad-hoc
+// log.Printf calls that used to scatter this information across individual
+// transports, giving operators one place to go for per-request forensic
+// data when a policy decision is appealed.
+type auditTransport struct {
+	rt   http.RoundTripper
+	sink auditSink
+}
+
+func newAuditTransport(rt http.RoundTripper, sink auditSink) *auditTransport {
+	return &auditTransport{rt: rt, sink: sink}
+}
+
+// auditRecords maps in-flight requests to the record being built for them,
+// so that code elsewhere in the proxy (classification, once it completes)
+// can attach information the transport layer doesn't have yet.
+var auditRecords sync.Map // *http.Request -> *auditRecord
+
+// recordClassification attaches a classification result to the audit
+// record for req, if one is being kept. Called once a response's content
+// has been scanned and scored.
+func recordClassification(req *http.Request, classification string) {
+	if v, ok := auditRecords.Load(req); ok {
+		v.(*auditRecord).Classification = classification
+	}
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := &auditRecord{
+		Time:      time.Now(),
+		Method:    req.Method,
+		URL:       redactURL(req.URL).String(),
+		Headers:   redactHeaders(req.Header),
+		BytesSent: req.ContentLength,
+	}
+	if rule := proxyRuleFor(req); rule != nil && len(rule.Upstreams) > 0 {
+		rec.Proxy = rule.Upstreams[0].Name
+	}
+
+	auditRecords.Store(req, rec)
+	start := time.Now()
+
+	resp, err := t.rt.RoundTrip(req)
+	rec.TTFBMillis = time.Since(start).Milliseconds()
+
+	if err != nil {
+		rec.Error = err.Error()
+		auditRecords.Delete(req)
+		t.writeRecord(rec)
+		return resp, err
+	}
+
+	rec.StatusCode = resp.StatusCode
+	rec.HTTPVersion = resp.Proto
+	if resp.TLS != nil {
+		rec.TLSVersion = tlsVersionName(resp.TLS.Version)
+		rec.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+		if len(resp.TLS.PeerCertificates) > 0 {
+			rec.PeerCertSPKI = spkiFingerprint(resp.TLS.PeerCertificates[0])
+		}
+	}
+
+	resp.Body = &auditingBody{ReadCloser: resp.Body, req: req, rec: rec, t: t}
+	return resp, nil
+}
+
+func (t *auditTransport) writeRecord(rec *auditRecord) {
+	if err := t.sink.Write(rec); err != nil {
+		log.Printf("audit: could not write record for %s: %v", rec.URL, err)
+	}
+}
+
+// An auditingBody counts the bytes the client reads from a response body,
+// and writes the completed audit record to its sink once the body is
+// closed (whether by being read to EOF or abandoned early).
+type auditingBody struct {
+	io.ReadCloser
+	req  *http.Request
+	rec  *auditRecord
+	t    *auditTransport
+	once sync.Once
+}
+
+func (b *auditingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.rec.BytesReceived += int64(n)
+	return n, err
+}
+
+func (b *auditingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		auditRecords.Delete(b.req)
+		b.t.writeRecord(b.rec)
+	})
+	return err
+}
+
+// redactURL returns a copy of u with the password of any embedded userinfo
+// (e.g. FTP/SFTP credentials) stripped, keeping the username, and any query
+// parameter matching auditConfig.RedactQueryParams replaced by "REDACTED".
+// The password strip always happens, even when there's nothing to do on the
+// query string,
+// since url.URL.String() serializes a plaintext password right along with
+// the rest of the URL otherwise.
+func redactURL(u *url.URL) *url.URL {
+	clone := *u
+	if clone.User != nil {
+		clone.User = url.User(clone.User.Username())
+	}
+
+	if len(auditConfig.RedactQueryParams) == 0 || clone.RawQuery == "" {
+		return &clone
+	}
+
+	q := clone.Query()
+	for key := range q {
+		for _, re := range auditConfig.RedactQueryParams {
+			if re.MatchString(key) {
+				q.Set(key, "REDACTED")
+				break
+			}
+		}
+	}
+	clone.RawQuery = q.Encode()
+	return &clone
+}
+
+// redactHeaders copies h into a plain map, replacing the value of any
+// header listed in auditConfig.RedactHeaders with "REDACTED".
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for name := range h {
+		if isRedactedHeader(name) {
+			out[name] = "REDACTED"
+		} else {
+			out[name] = h.Get(name)
+		}
+	}
+	return out
+}
+
+func isRedactedHeader(name string) bool {
+	for _, h := range auditConfig.RedactHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionSSL30:
+		return "SSL3.0"
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+func spkiFingerprint(cert *x509.Certificate) string {
+	sum := hashSPKI(cert)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// A jsonLinesSink appends one JSON object per line to a file.
+type jsonLinesSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	f   *os.File
+}
+
+func newJSONLinesSink(path string) (*jsonLinesSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log %s: %v", path, err)
+	}
+	return &jsonLinesSink{enc: json.NewEncoder(f), f: f}, nil
+}
+
+func (s *jsonLinesSink) Write(rec *auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(rec)
+}
+
+func (s *jsonLinesSink) Close() error {
+	return s.f.Close()
+}
+
+// A syslogSink sends each audit record, marshaled as JSON, as one syslog
+// message.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(tag string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %v", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(rec *auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(b))
+}
+
+// A webhookSink POSTs each audit record, marshaled as JSON, to a
+// configured URL.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (s *webhookSink) Write(rec *auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("could not deliver audit record to webhook %s: %v", s.url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// pinMode controls how strictly a pinStore treats a certificate change for
+// a host.
+type pinMode int
+
+const (
+	// pinRotating allows the certificate to change, as long as the new one
+	// is signed by the same issuer SPKI as a previously-seen certificate.
+	pinRotating pinMode = iota
+	// pinSticky refuses any certificate change at all.
+	pinSticky
+)
+
+func (m pinMode) String() string {
+	if m == pinSticky {
+		return "sticky"
+	}
+	return "rotating"
+}
+
+// a spkiHash is the SHA-256 hash of a certificate's
+// RawSubjectPublicKeyInfo, used as the stable identifier for a pin.
+type spkiHash [sha256.Size]byte
+
+func hashSPKI(cert *x509.Certificate) spkiHash {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// A pin records one certificate (by SPKI hash) seen for a server name.
+type pin struct {
+	SPKI        spkiHash  `json:"spki"`
+	IssuerSPKI  spkiHash  `json:"issuerSpki"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	IssuerChain []string  `json:"issuerChain"` // subject DNs, leaf to root
+}
+
+// pinHistory is the set of pins recorded for one server name, plus the
+// administrator-configured mode for that host.
+type pinHistory struct {
+	Mode pinMode `json:"mode"`
+	Pins []*pin  `json:"pins"`
+}
+
+// pinStoreFlushInterval is how often a pinStore with unsaved changes
+// writes itself to disk.
+const pinStoreFlushInterval = 5 * time.Second
+
+// A pinStore is a concurrency-safe, persistent trust-on-first-use
+// certificate store keyed by server name. It lets hardValidationTransport
+// consult the full history of certificates seen for a host, not just the
+// one from its own lifetime, and it survives process restarts.
+//
+// check() runs on essentially every HTTPS response once a globalPinStore
+// is configured, so it must not block on disk I/O: rather than writing to
+// disk synchronously, it just marks the store dirty, and a background
+// goroutine flushes it to disk at most once per pinStoreFlushInterval.
+type pinStore struct {
+	mu       sync.Mutex
+	path     string
+	history  map[string]*pinHistory
+	maxHosts int // eviction limit; 0 means unlimited
+	dirty    bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newPinStore loads a pinStore from path, a JSON file, and starts the
+// background goroutine that periodically flushes it back to path. If path
+// does not exist, an empty store is returned; it will be created on the
+// first flush.
+func newPinStore(path string, maxHosts int) (*pinStore, error) {
+	s := &pinStore{
+		path:     path,
+		history:  make(map[string]*pinHistory),
+		maxHosts: maxHosts,
+		stop:     make(chan struct{}),
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not open pin store %s: %v", path, err)
+	}
+	if err == nil {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&s.history); err != nil {
+			return nil, fmt.Errorf("could not parse pin store %s: %v", path, err)
+		}
+	}
+
+	go s.flushLoop()
+
+	return s, nil
+}
+
+// flushLoop periodically saves the store to disk if it has unflushed
+// changes. It exits once s.stop is closed.
+func (s *pinStore) flushLoop() {
+	ticker := time.NewTicker(pinStoreFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *pinStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Printf("pin store: %v", err)
+		return
+	}
+	s.dirty = false
+}
+
+// Close stops the background flush goroutine, flushing any unsaved
+// changes first.
+func (s *pinStore) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// markDirtyLocked records that the store has changes not yet on disk. The
+// caller must hold s.mu.
+func (s *pinStore) markDirtyLocked() {
+	s.dirty = true
+}
+
+// saveLocked writes the store to disk immediately. The caller must hold
+// s.mu.
+func (s *pinStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not write pin store %s: %v", tmp, err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.history); err != nil {
+		f.Close()
+		return fmt.Errorf("could not encode pin store: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// check records that certs (leaf first) were seen for serverName, and
+// reports whether the leaf certificate is consistent with the store's
+// history: true if this is the first pin for the host, if the SPKI matches
+// a previously-seen one, or (for a rotating pin) if the new certificate was
+// issued by the same issuer SPKI as a previous one.
+func (s *pinStore) check(serverName string, certs []*x509.Certificate) bool {
+	if len(certs) == 0 {
+		return false
+	}
+	leaf := hashSPKI(certs[0])
+	var issuer spkiHash
+	if len(certs) > 1 {
+		issuer = hashSPKI(certs[1])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.history[serverName]
+	now := time.Now()
+	isNewHost := !ok
+	if isNewHost {
+		h = &pinHistory{Mode: pinRotating}
+		s.history[serverName] = h
+	}
+
+	for _, p := range h.Pins {
+		if p.SPKI == leaf {
+			p.LastSeen = now
+			s.markDirtyLocked()
+			return true
+		}
+	}
+
+	// No pin matches the leaf certificate.
+	accepted := len(h.Pins) == 0
+	if !accepted && h.Mode == pinRotating {
+		for _, p := range h.Pins {
+			if p.IssuerSPKI == issuer {
+				accepted = true
+				break
+			}
+		}
+	}
+
+	if accepted {
+		chain := make([]string, len(certs))
+		for i, c := range certs {
+			chain[i] = c.Subject.String()
+		}
+		h.Pins = append(h.Pins, &pin{
+			SPKI:        leaf,
+			IssuerSPKI:  issuer,
+			FirstSeen:   now,
+			LastSeen:    now,
+			IssuerChain: chain,
+		})
+		s.markDirtyLocked()
+	}
+
+	// Evict only after this host's own pin (if any) has been recorded, so
+	// a brand-new host with a fresh LastSeen is never the "oldest" entry
+	// evictLocked immediately throws away.
+	if isNewHost {
+		s.evictLocked()
+	}
+
+	return accepted
+}
+
+// checkHostKey implements trust-on-first-use for a raw SSH host key (used
+// for the SFTP backend), persisted in the same store as TLS certificate
+// pins but under a distinct namespaced name so the two never collide. It
+// differs from check() in that it never does issuer-based rotation: raw
+// SSH host keys have no issuer chain, so once a key is on record for name,
+// only an exact match is ever accepted, regardless of pin mode.
+func (s *pinStore) checkHostKey(name string, key []byte) bool {
+	leaf := sha256.Sum256(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.history[name]
+	isNewHost := !ok
+	if isNewHost {
+		h = &pinHistory{Mode: pinSticky}
+		s.history[name] = h
+	}
+
+	for _, p := range h.Pins {
+		if p.SPKI == leaf {
+			p.LastSeen = now
+			s.markDirtyLocked()
+			return true
+		}
+	}
+
+	if len(h.Pins) > 0 {
+		return false
+	}
+
+	h.Pins = append(h.Pins, &pin{SPKI: leaf, FirstSeen: now, LastSeen: now})
+	s.markDirtyLocked()
+
+	// Evict only after this host's own pin has been recorded, so a
+	// brand-new host with a fresh LastSeen is never the "oldest" entry
+	// evictLocked immediately throws away.
+	if isNewHost {
+		s.evictLocked()
+	}
+
+	return true
+}
+
+// modeFor returns the configured pin mode for serverName, defaulting to
+// pinRotating if no history exists yet.
+func (s *pinStore) modeFor(serverName string) pinMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h, ok := s.history[serverName]; ok {
+		return h.Mode
+	}
+	return pinRotating
+}
+
+// setMode sets the pin mode (sticky or rotating) for serverName.
+func (s *pinStore) setMode(serverName string, mode pinMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.history[serverName]
+	if !ok {
+		h = &pinHistory{}
+		s.history[serverName] = h
+	}
+	h.Mode = mode
+	if err := s.saveLocked(); err != nil {
+		log.Printf("pin store: %v", err)
+	}
+}
+
+// revoke removes all pins recorded for serverName.
+func (s *pinStore) revoke(serverName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.history, serverName)
+	if err := s.saveLocked(); err != nil {
+		log.Printf("pin store: %v", err)
+	}
+}
+
+// list returns a snapshot of the store's contents, safe for the caller to
+// read without further locking.
+func (s *pinStore) list() map[string]*pinHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]*pinHistory, len(s.history))
+	for name, h := range s.history {
+		copied := *h
+		copied.Pins = make([]*pin, len(h.Pins))
+		for i, p := range h.Pins {
+			pc := *p
+			copied.Pins[i] = &pc
+		}
+		out[name] = &copied
+	}
+	return out
+}
+
+// evictLocked drops the least-recently-seen host's history once the store
+// holds more than s.maxHosts entries. The caller must hold s.mu.
+func (s *pinStore) evictLocked() {
+	if s.maxHosts <= 0 || len(s.history) <= s.maxHosts {
+		return
+	}
+
+	var oldestName string
+	var oldestTime time.Time
+	for name, h := range s.history {
+		last := time.Time{}
+		for _, p := range h.Pins {
+			if p.LastSeen.After(last) {
+				last = p.LastSeen
+			}
+		}
+		if oldestName == "" || last.Before(oldestTime) {
+			oldestName, oldestTime = name, last
+		}
+	}
+	if oldestName != "" {
+		delete(s.history, oldestName)
+	}
+}
+
+// globalPinStore is the process-wide TOFU store consulted by
+// newHardValidationTransport. It is set up during configuration loading.
+var globalPinStore *pinStore
+
+// pinsAdminHandler serves a small admin endpoint for listing and revoking
+// certificate pins: GET lists every pinned host, and POST with a
+// "revoke=host" form value clears that host's pins.
+func pinsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if globalPinStore == nil {
+		http.Error(w, "pin store not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method == "POST" {
+		host := r.FormValue("revoke")
+		if host == "" {
+			http.Error(w, "missing revoke parameter", http.StatusBadRequest)
+			return
+		}
+		globalPinStore.revoke(host)
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(globalPinStore.list())
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	httpTransport.RegisterProtocol("ftp", fileTransport{ftpBackend{}})
+	httpTransport.RegisterProtocol("ftps", fileTransport{ftpsBackend{}})
+	httpTransport.RegisterProtocol("sftp", fileTransport{sftpBackend{}})
+}
+
+// A fileStatusError is a backend error that should be reported to the
+// client with a specific HTTP status code, rather than as an opaque
+// transport failure.
+type fileStatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *fileStatusError) Error() string { return e.Err.Error() }
+
+func statusError(code int, format string, args ...interface{}) error {
+	return &fileStatusError{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// A fileBackend opens a remote file for reading, optionally starting at a
+// byte offset (to serve an HTTP Range request). It reports the total size
+// of the file if known, or -1 if not.
+type fileBackend interface {
+	Open(req *http.Request, offset int64) (body io.ReadCloser, size int64, err error)
+}
+
+// A fileTransport is a RoundTripper that fetches a single file from a
+// remote server (FTP, FTPS, or SFTP, depending on the backend) and adapts
+// it to the http.Response shape that the rest of redwood expects:
+// HTTP Range requests are translated to the backend's native seek/REST
+// support, and the response gets real status codes (404, 401, 403) instead
+// of an opaque pipe error, plus a sniffed Content-Type when the URL's
+// extension doesn't give one away.
+type fileTransport struct {
+	backend fileBackend
+}
+
+func (t fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return &http.Response{
+			StatusCode: http.StatusMethodNotAllowed,
+			Request:    req,
+		}, nil
+	}
+
+	var offset int64
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		var err error
+		offset, err = parseRangeStart(rangeHeader)
+		if err != nil {
+			return &http.Response{
+				StatusCode: http.StatusRequestedRangeNotSatisfiable,
+				Request:    req,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+	}
+
+	body, size, err := t.backend.Open(req, offset)
+	if err != nil {
+		if se, ok := err.(*fileStatusError); ok {
+			return &http.Response{
+				StatusCode: se.Code,
+				Request:    req,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(strings.NewReader(se.Error())),
+			}, nil
+		}
+		return nil, err
+	}
+
+	resp := &http.Response{
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     make(http.Header),
+	}
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	contentType, sniffedBody := sniffContentType(req.URL.Path, body)
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	resp.Body = sniffedBody
+
+	switch {
+	case offset > 0 && size >= 0:
+		resp.StatusCode = http.StatusPartialContent
+		resp.ContentLength = size - offset
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	case offset > 0:
+		// The backend already seeked/REST'd past offset, but can't report
+		// the file's total size (e.g. an FTP server with no SIZE support).
+		// The body is still a partial entity starting mid-file, so it must
+		// be marked 206, or a client would mistake it for the full file
+		// starting at byte 0.
+		resp.StatusCode = http.StatusPartialContent
+		resp.ContentLength = -1
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-*/*", offset))
+	case size >= 0:
+		resp.StatusCode = http.StatusOK
+		resp.ContentLength = size
+	default:
+		resp.StatusCode = http.StatusOK
+		resp.ContentLength = -1
+	}
+
+	return resp, nil
+}
+
+// parseRangeStart extracts the starting offset from a "bytes=N-" or
+// "bytes=N-M" Range header. Only the start offset N is used: the end offset
+// M is ignored, so the body runs to the end of the file, and of several
+// comma-separated ranges only the first is read. A range without an
+// explicit start (e.g. a suffix range "bytes=-N") is an error, since the
+// file backends can only seek to a byte offset.
+func parseRangeStart(header string) (int64, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, fmt.Errorf("unsupported Range header: %q", header)
+	}
+	spec := strings.TrimPrefix(header, prefix)
+	if i := strings.Index(spec, ","); i != -1 {
+		spec = spec[:i] // only the first range is honored
+	}
+	dash := strings.Index(spec, "-")
+	if dash <= 0 {
+		return 0, fmt.Errorf("unsupported Range header: %q", header)
+	}
+	return strconv.ParseInt(spec[:dash], 10, 64)
+}
+
+// sniffContentType determines the Content-Type for a file served from
+// urlPath. If the path's extension gives an unambiguous answer, r is
+// returned unchanged. Otherwise the first 512 bytes of r are buffered and
+// passed to http.DetectContentType, and a reader that replays them ahead of
+// the rest of the body is returned.
+func sniffContentType(urlPath string, r io.ReadCloser) (string, io.ReadCloser) {
+	if ext := path.Ext(urlPath); ext != "" {
+		if ct := mime.TypeByExtension(ext); ct != "" {
+			return ct, r
+		}
+	}
+
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+
+	return http.DetectContentType(buf), struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bufio.NewReader(&byteReader{buf}), r), r}
+}
+
+type byteReader struct{ b []byte }
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// An ftpBackend fetches files over plain FTP.
+type ftpBackend struct{}
+
+func (ftpBackend) Open(req *http.Request, offset int64) (io.ReadCloser, int64, error) {
+	return ftpOpen(req, offset, false)
+}
+
+// An ftpsBackend fetches files over FTP with explicit TLS (FTPS).
+type ftpsBackend struct{}
+
+func (ftpsBackend) Open(req *http.Request, offset int64) (io.ReadCloser, int64, error) {
+	return ftpOpen(req, offset, true)
+}
+
+func ftpOpen(req *http.Request, offset int64, explicitTLS bool) (io.ReadCloser, int64, error) {
+	host := req.URL.Host
+	if !strings.Contains(host, ":") {
+		host += ":21"
+	}
+
+	opts := []ftp.DialOption{
+		ftp.DialWithTimeout(dialer.Timeout),
+		ftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+			return dialThroughChain(req, network, address)
+		}),
+	}
+	if explicitTLS {
+		opts = append(opts, ftp.DialWithExplicitTLS(&tls.Config{ServerName: req.URL.Hostname()}))
+	}
+
+	c, err := ftp.Dial(host, opts...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not connect to %s: %v", host, err)
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if req.URL.User != nil {
+		user = req.URL.User.Username()
+		password, _ = req.URL.User.Password()
+	}
+	if err := c.Login(user, password); err != nil {
+		c.Quit()
+		return nil, 0, statusError(http.StatusUnauthorized, "FTP login to %s failed: %v", host, err)
+	}
+
+	size, err := c.FileSize(req.URL.Path)
+	if err != nil {
+		// Not every server implements SIZE; treat it as unknown rather than
+		// a hard failure.
+		size = -1
+	}
+
+	r, err := c.RetrFrom(req.URL.Path, uint64(offset))
+	if err != nil {
+		c.Quit()
+		return nil, 0, statusError(http.StatusNotFound, "FTP: could not retrieve %s: %v", req.URL, err)
+	}
+
+	return &ftpResponseCloser{Response: r, conn: c}, size, nil
+}
+
+// ftpResponseCloser closes both the FTP data connection and the control
+// connection when the response body is closed.
+type ftpResponseCloser struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+}
+
+func (c *ftpResponseCloser) Close() error {
+	err := c.Response.Close()
+	c.conn.Quit()
+	return err
+}
+
+// sftpHostKeyCallback returns an ssh.HostKeyCallback that checks the
+// server's host key against globalPinStore, the same persistent
+// trust-on-first-use store used for TLS certificate pinning, under a name
+// namespaced so it can't collide with a TLS pin for the same hostname. If
+// no pin store is configured, it falls back to accepting any host key
+// (with no persistence across restarts), since there is no other
+// known_hosts mechanism wired in here; this is logged so it isn't silent.
+func sftpHostKeyCallback(host string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if globalPinStore == nil {
+			log.Printf("SFTP: no pin store configured; accepting host key for %s without persisting it", hostname)
+			return nil
+		}
+		if globalPinStore.checkHostKey("ssh-hostkey:"+host, key.Marshal()) {
+			return nil
+		}
+		return fmt.Errorf("host key for %s does not match the pinned key on record", hostname)
+	}
+}
+
+// An sftpBackend fetches files over SFTP (FTP over SSH).
+type sftpBackend struct{}
+
+func (sftpBackend) Open(req *http.Request, offset int64) (io.ReadCloser, int64, error) {
+	host := req.URL.Host
+	if !strings.Contains(host, ":") {
+		host += ":22"
+	}
+
+	user := "anonymous"
+	var auth []ssh.AuthMethod
+	if req.URL.User != nil {
+		user = req.URL.User.Username()
+		if password, ok := req.URL.User.Password(); ok {
+			auth = append(auth, ssh.Password(password))
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: sftpHostKeyCallback(host),
+		Timeout:         dialer.Timeout,
+	}
+
+	conn, err := dialThroughChain(req, "tcp", host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("SFTP: could not connect to %s: %v", host, err)
+	}
+	sshConnRaw, chans, reqs, err := ssh.NewClientConn(conn, host, config)
+	if err != nil {
+		conn.Close()
+		return nil, 0, statusError(http.StatusUnauthorized, "SFTP: could not authenticate to %s: %v", host, err)
+	}
+	sshConn := ssh.NewClient(sshConnRaw, chans, reqs)
+
+	client, err := sftp.NewClient(sshConn)
+	if err != nil {
+		sshConn.Close()
+		return nil, 0, fmt.Errorf("SFTP: could not start session with %s: %v", host, err)
+	}
+
+	f, err := client.Open(req.URL.Path)
+	if err != nil {
+		client.Close()
+		sshConn.Close()
+		if os.IsNotExist(err) {
+			return nil, 0, statusError(http.StatusNotFound, "SFTP: no such file %s: %v", req.URL.Path, err)
+		}
+		return nil, 0, statusError(http.StatusForbidden, "SFTP: could not open %s: %v", req.URL.Path, err)
+	}
+
+	var size int64 = -1
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			client.Close()
+			sshConn.Close()
+			return nil, 0, fmt.Errorf("SFTP: could not seek to offset %d in %s: %v", offset, req.URL.Path, err)
+		}
+	}
+
+	return &sftpResponseCloser{File: f, client: client, conn: sshConn}, size, nil
+}
+
+// sftpResponseCloser closes the open file, the SFTP session, and the
+// underlying SSH connection together when the response body is closed.
+type sftpResponseCloser struct {
+	*sftp.File
+	client *sftp.Client
+	conn   *ssh.Client
+}
+
+func (c *sftpResponseCloser) Close() error {
+	err := c.File.Close()
+	c.client.Close()
+	c.conn.Close()
+	return err
+}
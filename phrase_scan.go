@@ -3,103 +3,235 @@ package main
 // scanning an HTTP response for phrases
 
 import (
-	"bytes"
+	"bufio"
 	"code.google.com/p/mahonia"
+	"compress/flate"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
 	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
 )
 
-// scanContent scans the content of a document for phrases,
-// and updates its counts and scores.
-func (c *context) scanContent() {
-	if c.charset == "" {
-		c.findCharset()
-	}
-	decode := mahonia.NewDecoder(c.charset)
+// scanConfig controls how much of a response body gets scanned for
+// phrases. It is set from the main configuration file.
+var scanConfig = struct {
+	// MaxScanBytes is the most decoded content that will be fed to the
+	// phrase scanner per response; 0 means no limit. For huge downloads,
+	// classification is based on just the first MaxScanBytes and then
+	// stops, while the rest of the body still streams to the client.
+	MaxScanBytes int64
+}{
+	MaxScanBytes: 4 << 20, // 4 MiB
+}
+
+// A phraseStreamScanner feeds a phraseScanner incrementally as bytes
+// arrive, instead of requiring the whole response body to be decoded and
+// buffered first. It implements io.Writer so it can sit on the receiving
+// end of an io.TeeReader. Its scanner state (ps.tally, prevRune) persists
+// across writes, so phrase matches that span a chunk boundary are still
+// detected; bytes left over at the end of a write because they don't yet
+// form a complete character are carried over to the next one.
+type phraseStreamScanner struct {
+	ps       *phraseScanner
+	decode   mahonia.Decoder
+	pending  []byte
+	prevRune rune
+
+	scanned int64
+	maxScan int64
+	done    bool // true once maxScan has been reached
+}
+
+func newPhraseStreamScanner(charset, contentType string, maxScan int64) *phraseStreamScanner {
+	decode := mahonia.NewDecoder(charset)
 	if decode == nil {
-		log.Printf("Unsupported charset (%s) on %s", c.charset, c.URL())
+		log.Printf("Unsupported charset (%s)", charset)
 		decode = mahonia.NewDecoder("utf-8")
 	}
-	if strings.Contains(c.contentType(), "html") {
+	if strings.Contains(contentType, "html") {
 		decode = mahonia.FallbackDecoder(mahonia.EntityDecoder(), decode)
 	}
 
-	content := c.content
-
 	ps := newPhraseScanner()
 	ps.scanByte(' ')
-	prevRune := ' '
-	var buf [4]byte // buffer for UTF-8 encoding of runes
+
+	return &phraseStreamScanner{
+		ps:       ps,
+		decode:   decode,
+		prevRune: ' ',
+		maxScan:  maxScan,
+	}
+}
+
+// Write decodes as much of p as it can and scans it for phrases. It never
+// returns an error; once maxScan has been reached, it just discards further
+// input so that streaming to the client can continue uninterrupted.
+func (s *phraseStreamScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.done {
+		return n, nil
+	}
+
+	content := append(s.pending, p...)
+	var buf [4]byte
 
 loop:
 	for len(content) > 0 {
-		// Read one Unicode character from content.
-		c, size, status := decode(content)
+		if s.maxScan > 0 && s.scanned >= s.maxScan {
+			s.done = true
+			content = nil
+			break
+		}
+
+		c, size, status := s.decode(content)
+		if status == mahonia.NO_ROOM {
+			// Not enough bytes yet for a full character; wait for more.
+			break loop
+		}
 		content = content[size:]
-		switch status {
-		case mahonia.STATE_ONLY:
+		s.scanned += int64(size)
+		if status == mahonia.STATE_ONLY {
 			continue
-		case mahonia.NO_ROOM:
-			break loop
 		}
 
-		// Simplify it to lower-case words separated by single spaces.
 		c = wordRune(c)
-		if c == ' ' && prevRune == ' ' {
+		if c == ' ' && s.prevRune == ' ' {
 			continue
 		}
-		prevRune = c
+		s.prevRune = c
 
-		// Convert it to UTF-8 and scan the bytes.
 		if c < 128 {
-			ps.scanByte(byte(c))
+			s.ps.scanByte(byte(c))
 			continue
 		}
-		n := utf8.EncodeRune(buf[:], c)
-		for _, b := range buf[:n] {
-			ps.scanByte(b)
+		rn := utf8.EncodeRune(buf[:], c)
+		for _, b := range buf[:rn] {
+			s.ps.scanByte(b)
 		}
 	}
 
-	ps.scanByte(' ')
+	s.pending = content
+	return n, nil
+}
 
-	for rule, n := range ps.tally {
+// finish flushes the scanner's trailing state and merges its tally into c.
+func (s *phraseStreamScanner) finish(c *context) {
+	s.ps.scanByte(' ')
+	for rule, n := range s.ps.tally {
 		c.tally[rule] += n
 	}
+}
+
+// scanContent scans the content of a document for phrases,
+// and updates its counts and scores.
+func (c *context) scanContent() {
+	if c.charset == "" {
+		c.findCharset()
+	}
+
+	s := newPhraseStreamScanner(c.charset, c.contentType(), 0)
+	s.Write(c.content)
+	s.finish(c)
+	c.calculateScores()
+}
+
+// streamAndScan copies res's (decompressed) body to w as soon as bytes
+// arrive, while scanning a decoded copy for phrases through an
+// io.TeeReader. This lets large downloads start reaching the client
+// immediately instead of waiting for the whole body to be read into memory
+// and scanned byte-by-byte first, the way responseContent/scanContent used
+// to work.
+func (c *context) streamAndScan(w io.Writer, res *http.Response) error {
+	body, err := decodingReader(res)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if c.charset == "" {
+		c.findCharset()
+	}
+
+	scanner := newPhraseStreamScanner(c.charset, c.contentType(), scanConfig.MaxScanBytes)
+	_, err = io.Copy(w, io.TeeReader(body, scanner))
+	scanner.finish(c)
 	c.calculateScores()
+	return err
 }
 
-// responseContent reads the body of an HTTP response into a slice of bytes.
-// It decompresses gzip-encoded responses.
+// responseContent reads the (decompressed) body of an HTTP response into a
+// slice of bytes. Prefer context.streamAndScan for the normal proxying
+// path; this remains for callers that need the whole body at once.
 func responseContent(res *http.Response) []byte {
-	r := res.Body
+	r, err := decodingReader(res)
+	if err != nil {
+		panic(err)
+	}
 	defer r.Close()
 
-	if res.Header.Get("Content-Encoding") == "gzip" {
-		gzContent, err := ioutil.ReadAll(r)
-		if err != nil {
-			panic(fmt.Errorf("error reading gzipped content for %s: %s", res.Request.URL, err))
-		}
-		if len(gzContent) == 0 {
-			// If the compressed content is empty, decompress it to empty content.
-			return nil
+	content, _ := ioutil.ReadAll(r)
+	// Deliberately ignore the error. ebay.com searches produce errors, but work.
+
+	return content
+}
+
+// decodingReader wraps res.Body so that it yields decompressed bytes,
+// transparently handling the gzip, deflate, and br (Brotli)
+// Content-Encodings, and removes the Content-Encoding header since callers
+// will only ever see decompressed content. If res isn't compressed with a
+// Content-Encoding this package knows how to handle, res.Body is returned
+// unchanged.
+func decodingReader(res *http.Response) (io.ReadCloser, error) {
+	var r io.Reader
+	var decoder io.Closer
+
+	switch res.Header.Get("Content-Encoding") {
+	case "gzip":
+		br := bufio.NewReader(res.Body)
+		if _, err := br.Peek(1); err == io.EOF {
+			// An empty body isn't a valid gzip stream, but it decompresses
+			// to empty content just fine.
+			res.Header.Del("Content-Encoding")
+			return res.Body, nil
 		}
-		gz, err := gzip.NewReader(bytes.NewBuffer(gzContent))
+		gz, err := gzip.NewReader(br)
 		if err != nil {
-			panic(fmt.Errorf("could not create gzip decoder for %s: %s", res.Request.URL, err))
+			return nil, fmt.Errorf("could not create gzip decoder for %s: %v", res.Request.URL, err)
 		}
-		defer gz.Close()
-		r = gz
-		res.Header.Del("Content-Encoding")
+		r, decoder = gz, gz
+	case "deflate":
+		fr := flate.NewReader(res.Body)
+		r, decoder = fr, fr
+	case "br":
+		r = brotli.NewReader(res.Body)
+	default:
+		return res.Body, nil
 	}
 
-	content, _ := ioutil.ReadAll(r)
-	// Deliberately ignore the error. ebay.com searches produce errors, but work.
+	res.Header.Del("Content-Encoding")
+	return &decodedBody{r: r, decoder: decoder, body: res.Body}, nil
+}
 
-	return content
+// decodedBody combines a decompressing Reader with the io.Closer(s) that
+// need to be closed when the caller is done with it: the decompressor
+// itself (if any) and the original response body.
+type decodedBody struct {
+	r       io.Reader
+	decoder io.Closer // the decompressor, if it has its own resources to release
+	body    io.Closer // the underlying response body
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) { return d.r.Read(p) }
+
+func (d *decodedBody) Close() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+	return d.body.Close()
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// An upstreamProxy is one entry in a proxy chain: either an HTTP CONNECT
+// proxy or a SOCKS5 proxy, with optional authentication.
+type upstreamProxy struct {
+	Name    string
+	URL     *url.URL // scheme is "http", "https", or "socks5"
+	Healthy int32    // accessed atomically; 0 means healthy, 1 means down
+
+	dialer proxy.Dialer
+}
+
+func newUpstreamProxy(name, rawURL string) (*upstreamProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL %q: %v", rawURL, err)
+	}
+
+	p := &upstreamProxy{Name: name, URL: u}
+
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			auth = &proxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("could not create SOCKS5 dialer for %q: %v", rawURL, err)
+		}
+		p.dialer = d
+	case "http", "https":
+		// Dialing is done with a CONNECT request in connectDial below;
+		// p.dialer is left nil for this case.
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q in %q", u.Scheme, rawURL)
+	}
+
+	return p, nil
+}
+
+func (p *upstreamProxy) markHealthy(ok bool) {
+	if ok {
+		atomic.StoreInt32(&p.Healthy, 0)
+	} else {
+		atomic.StoreInt32(&p.Healthy, 1)
+	}
+}
+
+func (p *upstreamProxy) isHealthy() bool {
+	return atomic.LoadInt32(&p.Healthy) == 0
+}
+
+// dial connects to addr through the upstream proxy.
+func (p *upstreamProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p.dialer != nil {
+		return p.dialer.Dial(network, addr)
+	}
+	return p.connectDial(ctx, network, addr)
+}
+
+// connectDial implements dialing through an HTTP CONNECT proxy.
+func (p *upstreamProxy) connectDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, p.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy %s: %v", p.Name, err)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.URL.User != nil {
+		pass, _ := p.URL.User.Password()
+		req.SetBasicAuth(p.URL.User.Username(), pass)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not send CONNECT request to proxy %s: %v", p.Name, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not read CONNECT response from proxy %s: %v", p.Name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", p.Name, addr, resp.Status)
+	}
+
+	return conn, nil
+}
+
+// A proxyRule selects an upstream proxy (or chain of upstreams, tried in
+// order on failure) for requests matching it. Rules are evaluated in order;
+// the first match wins. An empty field in a rule matches anything.
+type proxyRule struct {
+	Category    string         // ACL category classification, e.g. "proxies", "streaming-media"
+	User        string         // authenticated user or group name
+	DestPattern *regexp.Regexp // matched against the destination host
+	SNIPattern  *regexp.Regexp // matched against the TLS SNI server name, if any
+
+	Upstreams []*upstreamProxy // tried in order until one succeeds
+}
+
+func (r *proxyRule) matches(category, user, destHost, sni string) bool {
+	if r.Category != "" && r.Category != category {
+		return false
+	}
+	if r.User != "" && r.User != user {
+		return false
+	}
+	if r.DestPattern != nil && !r.DestPattern.MatchString(destHost) {
+		return false
+	}
+	if r.SNIPattern != nil && !r.SNIPattern.MatchString(sni) {
+		return false
+	}
+	return true
+}
+
+// A proxyChainTransport wraps an existing RoundTripper (usually
+// httpTransport or insecureHTTPTransport), dialing connections through an
+// upstream proxy chosen at dial time according to a set of ACL-style rules.
+// If a chosen upstream is unhealthy or fails to connect, it tries the next
+// upstream in the rule's chain, then the upstreams of the next matching
+// rule, and finally falls through to a direct connection.
+type proxyChainTransport struct {
+	rt    *http.Transport
+	rules []*proxyRule
+
+	healthCheckInterval time.Duration
+	stop                chan struct{}
+	stopOnce            sync.Once
+}
+
+// newProxyChainTransport returns a proxyChainTransport that uses base's
+// TLSClientConfig and other settings, but dials connections according to
+// rules.
+func newProxyChainTransport(base *http.Transport, rules []*proxyRule) *proxyChainTransport {
+	t := &proxyChainTransport{
+		rules:               rules,
+		healthCheckInterval: time.Minute,
+		stop:                make(chan struct{}),
+	}
+
+	clone := base.Clone()
+	// Routing is entirely decided by dialContext's rule matching now; leave
+	// http.ProxyFromEnvironment in place too and Go's Transport would dial
+	// the env proxy's address through dialContext instead of the real
+	// destination, stacking env-based proxying on top of (and defeating)
+	// the ACL-selected chain.
+	clone.Proxy = nil
+	clone.DialContext = t.dialContext
+	t.rt = clone
+
+	go t.healthCheckLoop()
+
+	return t
+}
+
+// requestMetadata, when present in a request's context, supplies the
+// category/user/SNI information that proxyRules are matched against.
+// classifyContext and related code populate it before calling RoundTrip.
+type requestMetadata struct {
+	Category string
+	User     string
+	SNI      string
+}
+
+type requestMetadataKey struct{}
+
+func withRequestMetadata(req *http.Request, md requestMetadata) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestMetadataKey{}, md))
+}
+
+func requestMetadataFrom(ctx context.Context) requestMetadata {
+	md, _ := ctx.Value(requestMetadataKey{}).(requestMetadata)
+	return md
+}
+
+func (t *proxyChainTransport) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	md := requestMetadataFrom(ctx)
+	host, _, _ := net.SplitHostPort(addr)
+
+	for _, rule := range t.rules {
+		if !rule.matches(md.Category, md.User, host, md.SNI) {
+			continue
+		}
+		for _, up := range rule.Upstreams {
+			if !up.isHealthy() {
+				continue
+			}
+			conn, err := up.dial(ctx, network, addr)
+			if err == nil {
+				return conn, nil
+			}
+			up.markHealthy(false)
+		}
+		// All of this rule's upstreams are down; fall through to the next
+		// matching rule, or to a direct connection if none remain.
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (t *proxyChainTransport) healthCheckLoop() {
+	ticker := time.NewTicker(t.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.checkHealth()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *proxyChainTransport) checkHealth() {
+	seen := make(map[*upstreamProxy]bool)
+	for _, rule := range t.rules {
+		for _, up := range rule.Upstreams {
+			if seen[up] || up.isHealthy() {
+				continue
+			}
+			seen[up] = true
+			// Dial the proxy itself directly, not through up.dial: for a
+			// SOCKS5 upstream, up.dial would ask the proxy to open a
+			// connection back to its own listening address, and for an
+			// HTTP upstream it would CONNECT to its own address — neither
+			// actually exercises reachability of the proxy.
+			conn, err := dialer.DialContext(context.Background(), "tcp", up.URL.Host)
+			if err == nil {
+				conn.Close()
+				up.markHealthy(true)
+			}
+		}
+	}
+}
+
+func (t *proxyChainTransport) Close() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	return nil
+}
+
+func (t *proxyChainTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, errors.New("proxyChainTransport only supports http and https requests")
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// activeProxyRules holds the rules configured for the running proxy, set by
+// loadConfiguration. It is consulted by transports (like simpleTransport and
+// fileTransport) that don't go through a proxyChainTransport but should still
+// honor the proxy chain where they can.
+var activeProxyRules []*proxyRule
+
+// proxyRuleFor returns the first proxyRule matching req, or nil if none
+// apply.
+func proxyRuleFor(req *http.Request) *proxyRule {
+	md := requestMetadataFrom(req.Context())
+	host := req.URL.Hostname()
+	for _, rule := range activeProxyRules {
+		if rule.matches(md.Category, md.User, host, md.SNI) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// dialThroughChain dials addr for req, routing through the matching
+// upstream proxy chain if one applies, or connecting directly otherwise.
+func dialThroughChain(req *http.Request, network, addr string) (net.Conn, error) {
+	rule := proxyRuleFor(req)
+	if rule == nil {
+		return dialer.Dial(network, addr)
+	}
+
+	for _, up := range rule.Upstreams {
+		if !up.isHealthy() {
+			continue
+		}
+		conn, err := up.dial(req.Context(), network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		up.markHealthy(false)
+	}
+
+	return dialer.Dial(network, addr)
+}
@@ -8,18 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"mime"
 	"net"
 	"net/http"
 	"net/textproto"
-	"path"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/remogatto/ftpget"
 	"golang.org/x/net/http2"
 )
 
@@ -37,10 +33,6 @@ var httpTransport = &http.Transport{
 	MaxConnsPerHost:       8,
 }
 
-func init() {
-	httpTransport.RegisterProtocol("ftp", FTPTransport{})
-}
-
 var insecureHTTPTransport = &http.Transport{
 	TLSClientConfig:       unverifiedClientConfig,
 	Proxy:                 http.ProxyFromEnvironment,
@@ -88,7 +80,28 @@ type hardValidationTransport struct {
 
 var errCouldNotVerify = errors.New("server certificate changed; can't verify the new certificate")
 
-func newHardValidationTransport(rt http.RoundTripper, serverName string, certificates []*x509.Certificate) *hardValidationTransport {
+// newHardValidationTransport builds a hardValidationTransport wrapping rt.
+// If rt is nil, it wraps defaultUpstreamTransport, which picks HTTP/3,
+// HTTP/2, or HTTP/1.1 per host; this is the normal case for ordinary
+// upstream HTTPS connections.
+//
+// If a globalPinStore is configured and serverName has a sticky pin on
+// record that certificates' leaf doesn't match, newHardValidationTransport
+// refuses to build a transport at all: a sticky pin means the operator has
+// said this certificate must never change, and that has to be enforced
+// from the very first connection of a process, not just on a later
+// mid-life re-validation.
+func newHardValidationTransport(rt http.RoundTripper, serverName string, certificates []*x509.Certificate) (*hardValidationTransport, error) {
+	if rt == nil {
+		rt = defaultUpstreamTransport
+	}
+
+	if globalPinStore != nil {
+		if !globalPinStore.check(serverName, certificates) && globalPinStore.modeFor(serverName) == pinSticky {
+			return nil, fmt.Errorf("certificate for %s does not match its sticky pin", serverName)
+		}
+	}
+
 	t := &hardValidationTransport{
 		rt:                   rt,
 		originalCertificates: certificates,
@@ -110,7 +123,7 @@ func newHardValidationTransport(rt http.RoundTripper, serverName string, certifi
 		DNSName: serverName,
 	})
 
-	return t
+	return t, nil
 }
 
 func sameType(a, b interface{}) bool {
@@ -132,6 +145,16 @@ func (t *hardValidationTransport) RoundTrip(req *http.Request) (*http.Response,
 		return resp, nil
 	}
 
+	if globalPinStore != nil {
+		if globalPinStore.check(t.originalServerName, resp.TLS.PeerCertificates) {
+			return resp, nil
+		}
+		if globalPinStore.modeFor(t.originalServerName) == pinSticky {
+			resp.Body.Close()
+			return resp, errCouldNotVerify
+		}
+	}
+
 	serverCert := resp.TLS.PeerCertificates[0]
 	intermediates := x509.NewCertPool()
 	for _, ic := range resp.TLS.PeerCertificates[1:] {
@@ -195,7 +218,7 @@ func (simpleTransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 		host = net.JoinHostPort(host, "80")
 	}
 
-	conn, err := dialer.Dial("tcp", host)
+	conn, err := dialThroughChain(req, "tcp", host)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to %s: %v", host, err)
 	}
@@ -268,56 +291,3 @@ func (simpleTransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 
 	return resp, nil
 }
-
-// An FTPTransport fetches files via FTP.
-type FTPTransport struct{}
-
-func (FTPTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	if req.Method != "GET" {
-		return &http.Response{
-			StatusCode: http.StatusMethodNotAllowed,
-			Request:    req,
-		}, nil
-	}
-
-	fullPath := req.URL.Host + req.URL.Path
-	r, w := io.Pipe()
-	xfer, err := ftp.GetAsync(fullPath, w)
-	if err != nil {
-		return nil, err
-	}
-
-	go func() {
-		for stat := range xfer.Status {
-			switch stat {
-			case ftp.COMPLETED:
-				w.Close()
-				return
-			case ftp.ERROR:
-				err := <-xfer.Error
-				log.Printf("FTP: error downloading %v: %v", req.URL, err)
-				w.CloseWithError(err)
-				return
-			}
-		}
-	}()
-
-	resp = &http.Response{
-		StatusCode: 200,
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Request:    req,
-		Body:       r,
-		Header:     make(http.Header),
-	}
-
-	ext := path.Ext(req.URL.Path)
-	if ext != "" {
-		ct := mime.TypeByExtension(ext)
-		if ct != "" {
-			resp.Header.Set("Content-Type", ct)
-		}
-	}
-
-	return resp, nil
-}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// upstreamConfig holds the configuration knobs for protocol selection on
+// outgoing connections: whether HTTP/3 is enabled at all, and the size and
+// TTL of the Alt-Svc cache that remembers which hosts advertised it. These
+// are the fields the main configuration file should set directly when it's
+// loaded, the same way it sets other package-level config vars like
+// scanConfig and auditConfig. EnableHTTP3 is consulted on every request
+// (not just at transport construction time), so it can be changed at any
+// point.
+var upstreamConfig = struct {
+	EnableHTTP3     bool
+	AltSvcCacheSize int
+	AltSvcCacheTTL  time.Duration
+}{
+	EnableHTTP3:     false,
+	AltSvcCacheSize: 1024,
+	AltSvcCacheTTL:  24 * time.Hour,
+}
+
+// An altSvcCache remembers, for each host, an h3 (HTTP/3) endpoint
+// advertised in an Alt-Svc response header, so that upstreamTransport can
+// go straight to QUIC on later requests. It is an LRU cache with a bounded
+// number of entries. Only Alt-Svc h3 advertisements are stored; whether
+// HTTP/2 or HTTP/1.1 worked for a host is not recorded.
+type altSvcCache struct {
+	mu      sync.Mutex
+	maxLen  int // 0 means upstreamConfig.AltSvcCacheSize, read on each insertion
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type altSvcEntry struct {
+	host     string
+	protocol string
+	expires  time.Time
+}
+
+func newAltSvcCache(maxLen int) *altSvcCache {
+	return &altSvcCache{
+		maxLen:  maxLen,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// protocol returns the cached protocol for host, if any unexpired entry
+// exists.
+func (c *altSvcCache) protocol(host string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[host]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*altSvcEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, host)
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return entry.protocol, true
+}
+
+// set records that host should be tried with protocol until ttl has
+// elapsed. A ttl of zero uses upstreamConfig.AltSvcCacheTTL.
+func (c *altSvcCache) set(host, protocol string, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = upstreamConfig.AltSvcCacheTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[host]; ok {
+		e.Value.(*altSvcEntry).protocol = protocol
+		e.Value.(*altSvcEntry).expires = time.Now().Add(ttl)
+		c.order.MoveToFront(e)
+		return
+	}
+
+	e := c.order.PushFront(&altSvcEntry{host: host, protocol: protocol, expires: time.Now().Add(ttl)})
+	c.entries[host] = e
+
+	maxLen := c.maxLen
+	if maxLen == 0 {
+		maxLen = upstreamConfig.AltSvcCacheSize
+	}
+	for c.order.Len() > maxLen {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*altSvcEntry).host)
+	}
+}
+
+// parseAltSvc pulls an h3 entry out of an Alt-Svc header value, if present,
+// e.g. `h3=":443"; ma=86400, h2=":443"; ma=86400`.
+func parseAltSvc(header string) (protocol string, ttl time.Duration, ok bool) {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		proto := strings.TrimSpace(fields[0])
+		if i := strings.Index(proto, "="); i != -1 {
+			proto = proto[:i]
+		}
+		if proto != "h3" {
+			continue
+		}
+		ttl = upstreamConfig.AltSvcCacheTTL
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "ma=") {
+				if secs, err := time.ParseDuration(f[3:] + "s"); err == nil {
+					ttl = secs
+				}
+			}
+		}
+		return "h3", ttl, true
+	}
+	return "", 0, false
+}
+
+// An upstreamTransport is a RoundTripper that picks a protocol (HTTP/3 over
+// QUIC, HTTP/2, or HTTP/1.1) for each upstream request. If HTTP/3 is enabled
+// and the host has an h3 entry in its altSvcCache, HTTP/3 is tried first;
+// otherwise, or if that fails, HTTP/2 is tried, falling back to HTTP/1.1 if
+// HTTP/2 fails. A failed HTTP/3 attempt leaves the host's h3 entry in place
+// until it expires, and the HTTP/2 or HTTP/1.1 outcome is not remembered,
+// so every such request starts with HTTP/2 again.
+//
+// It composes with hardValidationTransport the same way httpTransport and
+// http2Transport do: RoundTrip returns a normal *http.Response with TLS set
+// to the connection's ConnectionState (quic-go's http3.RoundTripper
+// populates this from the QUIC TLS session), so the PeerCertificates
+// comparisons in hardValidationTransport.RoundTrip work unmodified.
+type upstreamTransport struct {
+	h1 http.RoundTripper
+	h2 http.RoundTripper
+	h3 *http3.RoundTripper
+
+	altSvc *altSvcCache
+}
+
+// defaultUpstreamTransport is the RoundTripper newHardValidationTransport
+// uses for ordinary HTTPS connections, in place of talking to
+// httpTransport/http2Transport directly. Routing through it is what gives
+// QUIC sessions the same cert pinning/re-validation as HTTP/1.1 and
+// HTTP/2 ones: it still returns a normal *http.Response with TLS set from
+// the connection's ConnectionState, which is all hardValidationTransport's
+// PeerCertificates comparisons need.
+var defaultUpstreamTransport = newUpstreamTransport(httpTransport, http2Transport)
+
+func newUpstreamTransport(h1, h2 http.RoundTripper) *upstreamTransport {
+	return &upstreamTransport{
+		h1:     h1,
+		h2:     h2,
+		h3:     &http3.RoundTripper{},
+		altSvc: newAltSvcCache(0), // sized from upstreamConfig on each insertion
+	}
+}
+
+// canRewind reports whether req has no body, or a body that can be
+// rewound via req.GetBody for a retry on a fallback RoundTripper.
+func canRewind(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewindBody replaces req.Body with a fresh copy obtained from
+// req.GetBody, undoing whatever a previous (failed) RoundTrip attempt
+// read from it. The caller must have already checked canRewind(req).
+func rewindBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	// A request whose body can't be rewound may only be sent to one
+	// RoundTripper, since a failed attempt can leave it read and closed.
+	// Skip straight to h2, the protocol this transport has always used,
+	// rather than risk resending an empty or truncated body on fallback.
+	if !canRewind(req) {
+		return t.h2.RoundTrip(req)
+	}
+
+	if upstreamConfig.EnableHTTP3 && req.URL.Scheme == "https" {
+		if proto, ok := t.altSvc.protocol(host); ok && proto == "h3" {
+			resp, err := t.h3.RoundTrip(req)
+			if err == nil {
+				return resp, nil
+			}
+			// QUIC connection failed (blocked UDP, middlebox interference,
+			// etc.); rewind the body and fall through to h2/h1 below.
+			if err := rewindBody(req); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	resp, err := t.h2.RoundTrip(req)
+	if err != nil {
+		if err := rewindBody(req); err != nil {
+			return nil, err
+		}
+		return t.h1.RoundTrip(req)
+	}
+
+	if upstreamConfig.EnableHTTP3 && req.URL.Scheme == "https" {
+		if altSvc := resp.Header.Get("Alt-Svc"); altSvc != "" {
+			if proto, ttl, ok := parseAltSvc(altSvc); ok {
+				t.altSvc.set(host, proto, ttl)
+			}
+		}
+	}
+
+	return resp, nil
+}